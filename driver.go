@@ -3,24 +3,32 @@ package main
 import (
   "bytes"
   "compress/gzip"
+  "compress/zlib"
   "context"
   "crypto/tls"
   "crypto/x509"
   "encoding/binary"
+  "encoding/json"
   "fmt"
   "io"
   "io/ioutil"
+  "math/rand"
   "net/http"
   "net/url"
+  "path/filepath"
   "strconv"
   "sync"
+  "sync/atomic"
   "syscall"
+  "text/template"
   "time"
 
   "github.com/docker/docker/api/types/plugins/logdriver"
   "github.com/docker/docker/daemon/logger"
   protoio "github.com/gogo/protobuf/io"
+  "github.com/klauspost/compress/zstd"
   "github.com/pkg/errors"
+  "github.com/prometheus/client_golang/prometheus"
   "github.com/sirupsen/logrus"
   "github.com/tonistiigi/fifo"
 )
@@ -34,6 +42,9 @@ const (
   /* Gzip compression level.
     Valid values are -1 (default), 0 (no compression), 1 (best speed) ... 9 (best compression). */
   logOptGzipCompressionLevel = "sumo-compress-level"
+  /* The compression algorithm to use when sumo-compress is enabled. One of "gzip" (default),
+    "deflate" or "zstd". Zstd at level 3 typically beats gzip-6 on both ratio and CPU cost. */
+  logOptCompressAlgorithm = "sumo-compress-algorithm"
   /* Used for TLS configuration.
     Allows users to set a proxy URL. */
   logOptProxyUrl = "sumo-proxy-url"
@@ -56,13 +67,77 @@ const (
     If the number of logs never reaches the batch size, the driver will send the logs in smaller
     batches at predefined intervals; see sending interval. */
   logOptBatchSize = "sumo-batch-size"
+  /* The maximum number of attempts the driver will make to deliver a batch before giving up
+    and dropping it. */
+  logOptRetryMaxAttempts = "sumo-retry-max-attempts"
+  /* The base interval used to compute the exponential backoff delay between retry attempts. */
+  logOptRetryBaseInterval = "sumo-retry-base-interval"
+  /* The upper bound on the backoff delay between retry attempts, regardless of attempt count. */
+  logOptRetryMaxInterval = "sumo-retry-max-interval"
+  /* The maximum total time the driver will spend retrying a single batch before dropping it. */
+  logOptRetryMaxElapsed = "sumo-retry-max-elapsed"
+  /* If set, enables an on-disk spool under this directory so logs survive driver restarts and
+    Sumo outages longer than the in-memory queue can buffer. Each container gets its own
+    sub-directory, named after its log fifo, under this path. */
+  logOptSpoolPath = "sumo-spool-path"
+  /* The maximum size in bytes of a single spool segment before it is rotated. */
+  logOptSpoolMaxSize = "sumo-spool-max-size"
+  /* The maximum number of rotated spool segments to retain on disk; older segments are deleted. */
+  logOptSpoolMaxFiles = "sumo-spool-max-files"
+  /* If set to true, rotated spool segments are gzip-compressed. */
+  logOptSpoolCompress = "sumo-spool-compress"
+  /* The payload format to send to Sumo: "text" (newline-delimited log lines, the default),
+    "json" (a JSON array of structured records per batch) or "ndjson" (newline-delimited
+    structured records). */
+  logOptFormat = "sumo-format"
+  /* The value to send as the X-Sumo-Category header. Supports Go templates evaluated against
+    the container's logger.Info, e.g. "{{.ContainerName}}". */
+  logOptSourceCategory = "sumo-source-category"
+  /* The value to send as the X-Sumo-Host header. Supports Go templates evaluated against the
+    container's logger.Info. */
+  logOptSourceHost = "sumo-source-host"
+  /* The value to send as the X-Sumo-Name header. Supports Go templates evaluated against the
+    container's logger.Info. */
+  logOptSourceName = "sumo-source-name"
+  /* The maximum number of bytes to buffer while reassembling a multi-fragment partial line
+    before emitting it as-is. */
+  logOptMaxLineBytes = "sumo-max-line-bytes"
+  /* How long to wait for the next fragment of a partial line before giving up and emitting
+    whatever has been buffered so far. */
+  logOptPartialTimeout = "sumo-partial-timeout"
+  /* If set (e.g. ":9090"), stands up an HTTP server exposing Prometheus metrics for this
+    container's logging pipeline at /metrics. */
+  logOptMetricsAddr = "sumo-metrics-addr"
 
+  formatText = "text"
+  formatJson = "json"
+  formatNdjson = "ndjson"
+
+  defaultFormat = formatText
   defaultGzipCompression = false
   defaultGzipCompressionLevel = gzip.DefaultCompression
   defaultInsecureSkipVerify = false
   defaultSendingInterval  = 2 * time.Second
   defaultQueueSize = 4000
   defaultBatchSize = 1000
+  defaultRetryMaxAttempts = 10
+  defaultRetryBaseInterval = 250 * time.Millisecond
+  defaultRetryMaxInterval = 30 * time.Second
+  defaultRetryMaxElapsed = 5 * time.Minute
+  defaultSpoolMaxSize = 64 * 1024 * 1024
+  defaultSpoolMaxFiles = 5
+  defaultSpoolCompress = true
+  defaultMaxLineBytes = fileReaderMaxSize
+  defaultPartialTimeout = 5 * time.Second
+
+  compressAlgorithmGzip = "gzip"
+  compressAlgorithmDeflate = "deflate"
+  compressAlgorithmZstd = "zstd"
+  defaultCompressAlgorithm = compressAlgorithmGzip
+  /* zstd compression level to compress with, mapped through zstd.EncoderLevelFromZstd (level 3
+    maps to zstd.SpeedDefault), spelled out explicitly so the configured level stays unambiguous
+    if zstd's defaults ever change. */
+  zstdCompressionLevel = 3
 
   fileMode = 0700
   fileReaderMaxSize = 1e6
@@ -93,11 +168,103 @@ type sumoLogger struct {
 
   gzipCompression bool
   gzipCompressionLevel int
+  compressAlgorithm string
+
+  format string
+  sourceCategory string
+  sourceHost string
+  sourceName string
+  containerID string
+  containerName string
+  containerImage string
+  containerLabels map[string]string
 
   inputQueueFile io.ReadWriteCloser
   logQueue chan *sumoLog
   sendingInterval time.Duration
   batchSize int
+
+  retryMaxAttempts int
+  retryBaseInterval time.Duration
+  retryMaxInterval time.Duration
+  retryMaxElapsed time.Duration
+  droppedBatches uint64
+
+  spool *diskSpool
+
+  maxLineBytes int
+  partialTimeout time.Duration
+  partialMu sync.Mutex
+  partialBuffers map[string]*partialLogBuffer
+
+  /* done is closed exactly once (guarded by stopOnce) to tell every background goroutine —
+    consumeLogsFromFile, flushStalePartialBuffers, tailSpool and queueLogsForSending — to wind
+    down, whichever of EOF-on-the-fifo or StopLogging happens first. logQueue itself is never
+    closed, since it has more than one producer once the spool or partial-flush goroutines are
+    involved; closing it from just one of them would panic the others on their next send. */
+  done chan struct{}
+  stopOnce sync.Once
+
+  metricsAddr string
+  metricsLabels prometheus.Labels
+}
+
+/* stop closes sumoLogger.done exactly once, however it is triggered. */
+func (sumoLogger *sumoLogger) stop() {
+  sumoLogger.stopOnce.Do(func() { close(sumoLogger.done) })
+}
+
+/* enqueue sends log to logQueue. For a log that came straight from the fifo the send never
+  blocks: if the logger is stopping the log may be discarded, and if logQueue is already at its
+  configured sumo-queue-size capacity the log is dropped (counted under the "queue_full" reason)
+  instead of applying backpressure all the way back to the container's fifo, so one slow or
+  wedged HTTP destination can't stall a container's stdout/stderr. A spool-backed log (one with
+  a spoolAck) instead waits for room in logQueue, or for the logger to stop, since it is already
+  buffered on disk and a later entry's ack would otherwise move the read cursor past it. */
+func (sumoLogger *sumoLogger) enqueue(log *sumoLog) {
+  if log.spoolAck != nil {
+    select {
+    case sumoLogger.logQueue <- log:
+    case <-sumoLogger.done:
+    }
+    return
+  }
+  select {
+  case sumoLogger.logQueue <- log:
+  case <-sumoLogger.done:
+  default:
+    sumoLogger.dropBatch(1, "queue_full", fmt.Errorf("log queue at capacity (%d)", cap(sumoLogger.logQueue)))
+  }
+}
+
+/* partialLogBuffer accumulates consecutive Partial fragments for a single source (stdout or
+  stderr must never be merged) until a non-partial fragment arrives, the buffer grows past
+  maxLineBytes, or partialTimeout elapses since the last fragment. */
+type partialLogBuffer struct {
+  line []byte
+  time string
+  lastUpdate time.Time
+
+  /* ack, when non-nil, is the most recently buffered fragment's spool ack; keeping only the
+    latest is enough since acking it also covers every earlier fragment merged into the same
+    buffer. */
+  ack func()
+}
+
+/* httpStatusError carries the HTTP response status and any Retry-After hint back to the
+  retry loop so it can tell a transient failure from a permanent one. */
+type httpStatusError struct {
+  statusCode int
+  retryAfter time.Duration
+  body string
+}
+
+func (err *httpStatusError) Error() string {
+  return fmt.Sprintf("%s: Failed to send event: %d - %s", pluginName, err.statusCode, err.body)
+}
+
+func (err *httpStatusError) isPermanent() bool {
+  return err.statusCode >= 400 && err.statusCode < 500 && err.statusCode != http.StatusTooManyRequests
 }
 
 type sumoLog struct {
@@ -105,6 +272,12 @@ type sumoLog struct {
   source string
   time string
   isPartial bool
+
+  /* spoolAck, when non-nil, persists the spool read cursor past this entry. It is called once
+    the batch containing this log has finished its delivery attempts: posted successfully, or
+    dropped after a permanent error or exhausted retries. A dropped batch is therefore not
+    re-read from the spool; only data whose batch has not finished yet is kept for re-reading. */
+  spoolAck func()
 }
 
 func newSumoDriver() *sumoDriver {
@@ -118,8 +291,17 @@ func (sumoDriver *sumoDriver) StartLogging(file string, info logger.Info) error
   if err != nil {
     return err
   }
+  if newSumoLogger.metricsAddr != "" {
+    if err := acquireMetricsServer(newSumoLogger.metricsAddr); err != nil {
+      return err
+    }
+  }
   go consumeLogsFromFile(newSumoLogger)
   go queueLogsForSending(newSumoLogger)
+  go flushStalePartialBuffers(newSumoLogger)
+  if newSumoLogger.spool != nil {
+    go tailSpool(newSumoLogger)
+  }
   return nil
 }
 
@@ -143,6 +325,15 @@ func (sumoDriver *sumoDriver) startLoggingInternal(file string, info logger.Info
       info.Config[logOptGzipCompressionLevel], logOptGzipCompressionLevel, defaultGzipCompressionLevel, gzip.BestCompression))
     gzipCompressionLevel = defaultGzipCompressionLevel
   }
+  compressAlgorithm := info.Config[logOptCompressAlgorithm]
+  if compressAlgorithm == "" {
+    compressAlgorithm = defaultCompressAlgorithm
+  }
+  if compressAlgorithm != compressAlgorithmGzip && compressAlgorithm != compressAlgorithmDeflate && compressAlgorithm != compressAlgorithmZstd {
+    logrus.Error(fmt.Errorf("%s must be one of %q, %q or %q, got %q. Using default %q.",
+      logOptCompressAlgorithm, compressAlgorithmGzip, compressAlgorithmDeflate, compressAlgorithmZstd, compressAlgorithm, defaultCompressAlgorithm))
+    compressAlgorithm = defaultCompressAlgorithm
+  }
 
   tlsConfig := &tls.Config{}
   tlsConfig.InsecureSkipVerify = parseLogOptBoolean(info, logOptInsecureSkipVerify, defaultInsecureSkipVerify)
@@ -187,6 +378,82 @@ func (sumoDriver *sumoDriver) startLoggingInternal(file string, info logger.Info
     batchSize = defaultBatchSize
   }
 
+  retryMaxAttempts := parseLogOptInt(info, logOptRetryMaxAttempts, defaultRetryMaxAttempts)
+  if retryMaxAttempts <= 0 {
+    logrus.Error(fmt.Errorf("%s must be a positive value, got %d. Using default %d.",
+      logOptRetryMaxAttempts, retryMaxAttempts, defaultRetryMaxAttempts))
+    retryMaxAttempts = defaultRetryMaxAttempts
+  }
+  retryBaseInterval := parseLogOptDuration(info, logOptRetryBaseInterval, defaultRetryBaseInterval)
+  if retryBaseInterval <= 0 {
+    logrus.Error(fmt.Errorf("%s must be a positive duration, got %s. Using default %s.",
+      logOptRetryBaseInterval, retryBaseInterval.String(), defaultRetryBaseInterval))
+    retryBaseInterval = defaultRetryBaseInterval
+  }
+  retryMaxInterval := parseLogOptDuration(info, logOptRetryMaxInterval, defaultRetryMaxInterval)
+  if retryMaxInterval <= 0 {
+    logrus.Error(fmt.Errorf("%s must be a positive duration, got %s. Using default %s.",
+      logOptRetryMaxInterval, retryMaxInterval.String(), defaultRetryMaxInterval))
+    retryMaxInterval = defaultRetryMaxInterval
+  }
+  retryMaxElapsed := parseLogOptDuration(info, logOptRetryMaxElapsed, defaultRetryMaxElapsed)
+  if retryMaxElapsed <= 0 {
+    logrus.Error(fmt.Errorf("%s must be a positive duration, got %s. Using default %s.",
+      logOptRetryMaxElapsed, retryMaxElapsed.String(), defaultRetryMaxElapsed))
+    retryMaxElapsed = defaultRetryMaxElapsed
+  }
+
+  format := info.Config[logOptFormat]
+  if format == "" {
+    format = defaultFormat
+  }
+  if format != formatText && format != formatJson && format != formatNdjson {
+    logrus.Error(fmt.Errorf("%s must be one of %q, %q or %q, got %q. Using default %q.",
+      logOptFormat, formatText, formatJson, formatNdjson, format, defaultFormat))
+    format = defaultFormat
+  }
+  sourceCategory := resolveSourceTemplate(info.Config[logOptSourceCategory], info)
+  sourceHost := resolveSourceTemplate(info.Config[logOptSourceHost], info)
+  sourceName := resolveSourceTemplate(info.Config[logOptSourceName], info)
+
+  maxLineBytes := parseLogOptInt(info, logOptMaxLineBytes, defaultMaxLineBytes)
+  if maxLineBytes <= 0 {
+    logrus.Error(fmt.Errorf("%s must be a positive value, got %d. Using default %d.",
+      logOptMaxLineBytes, maxLineBytes, defaultMaxLineBytes))
+    maxLineBytes = defaultMaxLineBytes
+  }
+  partialTimeout := parseLogOptDuration(info, logOptPartialTimeout, defaultPartialTimeout)
+  if partialTimeout <= 0 {
+    logrus.Error(fmt.Errorf("%s must be a positive duration, got %s. Using default %s.",
+      logOptPartialTimeout, partialTimeout.String(), defaultPartialTimeout))
+    partialTimeout = defaultPartialTimeout
+  }
+
+  metricsAddr := info.Config[logOptMetricsAddr]
+
+  var spool *diskSpool
+  if spoolPath, exists := info.Config[logOptSpoolPath]; exists && spoolPath != "" {
+    spoolMaxSize := int64(parseLogOptInt(info, logOptSpoolMaxSize, defaultSpoolMaxSize))
+    if spoolMaxSize <= 0 {
+      logrus.Error(fmt.Errorf("%s must be a positive value, got %d. Using default %d.",
+        logOptSpoolMaxSize, spoolMaxSize, defaultSpoolMaxSize))
+      spoolMaxSize = defaultSpoolMaxSize
+    }
+    spoolMaxFiles := parseLogOptInt(info, logOptSpoolMaxFiles, defaultSpoolMaxFiles)
+    if spoolMaxFiles <= 0 {
+      logrus.Error(fmt.Errorf("%s must be a positive value, got %d. Using default %d.",
+        logOptSpoolMaxFiles, spoolMaxFiles, defaultSpoolMaxFiles))
+      spoolMaxFiles = defaultSpoolMaxFiles
+    }
+    spoolCompress := parseLogOptBoolean(info, logOptSpoolCompress, defaultSpoolCompress)
+
+    containerSpoolDir := filepath.Join(spoolPath, filepath.Base(file))
+    spool, err = newDiskSpool(containerSpoolDir, spoolMaxSize, spoolMaxFiles, spoolCompress)
+    if err != nil {
+      return nil, err
+    }
+  }
+
   newSumoLogger := &sumoLogger{
     httpSourceUrl: info.Config[logOptUrl],
     httpClient: httpClient,
@@ -195,9 +462,33 @@ func (sumoDriver *sumoDriver) startLoggingInternal(file string, info logger.Info
     inputQueueFile: inputQueueFile,
     gzipCompression: gzipCompression,
     gzipCompressionLevel: gzipCompressionLevel,
+    compressAlgorithm: compressAlgorithm,
     logQueue: make(chan *sumoLog, queueSize),
     sendingInterval: sendingInterval,
     batchSize: batchSize,
+    retryMaxAttempts: retryMaxAttempts,
+    retryBaseInterval: retryBaseInterval,
+    retryMaxInterval: retryMaxInterval,
+    retryMaxElapsed: retryMaxElapsed,
+    spool: spool,
+    format: format,
+    sourceCategory: sourceCategory,
+    sourceHost: sourceHost,
+    sourceName: sourceName,
+    containerID: info.ContainerID,
+    containerName: info.ContainerName,
+    containerImage: info.ContainerImageName,
+    containerLabels: info.ContainerLabels,
+    maxLineBytes: maxLineBytes,
+    partialTimeout: partialTimeout,
+    partialBuffers: make(map[string]*partialLogBuffer),
+    done: make(chan struct{}),
+    metricsAddr: metricsAddr,
+    metricsLabels: prometheus.Labels{
+      "container_id": info.ContainerID,
+      "container_name": info.ContainerName,
+      "image": info.ContainerImageName,
+    },
   }
 
   sumoDriver.mu.Lock()
@@ -212,6 +503,16 @@ func (sumoDriver *sumoDriver) StopLogging(file string) error {
   sumoLogger, exists := sumoDriver.loggers[file]
   if exists {
     sumoLogger.inputQueueFile.Close()
+    sumoLogger.stop()
+    if sumoLogger.spool != nil {
+      if err := sumoLogger.spool.Close(); err != nil {
+        logrus.Error(err)
+      }
+    }
+    if sumoLogger.metricsAddr != "" {
+      unregisterContainerMetrics(sumoLogger.metricsLabels)
+      releaseMetricsServer(sumoLogger.metricsAddr)
+    }
     delete(sumoDriver.loggers, file)
   }
   sumoDriver.mu.Unlock()
@@ -226,41 +527,143 @@ func consumeLogsFromFile(sumoLogger *sumoLogger) {
     if err := dec.ReadMsg(&buf); err != nil {
       if err == io.EOF {
         sumoLogger.inputQueueFile.Close()
-        close(sumoLogger.logQueue)
+        sumoLogger.stop()
+        return
+      }
+      select {
+      case <-sumoLogger.done:
         return
+      default:
       }
       logrus.Error(err)
       dec = protoio.NewUint32DelimitedReader(sumoLogger.inputQueueFile, binary.BigEndian, fileReaderMaxSize)
     }
 
-    // TODO: handle multi-line detection via Partial
-    log := &sumoLog{
-      line: buf.Line,
-      source: buf.Source,
-      time: time.Unix(0, buf.TimeNano).String(),
-      isPartial: buf.Partial,
+    if sumoLogger.metricsAddr != "" {
+      logsReceivedTotal.With(sumoLogger.metricsLabels).Inc()
+    }
+
+    if sumoLogger.spool != nil {
+      if err := sumoLogger.spool.Write(&buf); err != nil {
+        logrus.Error(fmt.Errorf("error writing to spool, log dropped: %v", err))
+      }
+      buf.Reset()
+      continue
     }
-    sumoLogger.logQueue <- log
+
+    sumoLogger.handlePartialEntry(buf.Source, buf.Line, time.Unix(0, buf.TimeNano).String(), buf.Partial, nil)
     buf.Reset()
   }
 }
 
+/* handlePartialEntry implements per-source reassembly of Docker's Partial fragments, fixing
+  the well-known 16KB line-split problem: consecutive Partial fragments are buffered and
+  concatenated until a non-partial fragment arrives or maxLineBytes is exceeded, at which point
+  a single sumoLog carrying the first fragment's timestamp is emitted.
+
+  ack, when non-nil, is the spool ack for this fragment; it is carried onto whichever emitted
+  sumoLog the fragment ends up part of, so spool-backed entries still advance the read cursor
+  correctly even though several raw spool records can be merged into one emitted log. This is
+  also why reassembly has to happen here, after a spooled entry is read back, rather than when
+  it is first written to the spool: the spool stores raw per-fragment records, and only the
+  read side knows which batch (and therefore which ack) a merged log ultimately travels with. */
+func (sumoLogger *sumoLogger) handlePartialEntry(source string, line []byte, timestamp string, isPartial bool, ack func()) {
+  sumoLogger.partialMu.Lock()
+  buffered, exists := sumoLogger.partialBuffers[source]
+  if !exists {
+    buffered = &partialLogBuffer{time: timestamp}
+    sumoLogger.partialBuffers[source] = buffered
+  }
+  buffered.line = append(buffered.line, line...)
+  buffered.lastUpdate = time.Now()
+  buffered.ack = ack
+
+  if !isPartial || len(buffered.line) > sumoLogger.maxLineBytes {
+    delete(sumoLogger.partialBuffers, source)
+    sumoLogger.partialMu.Unlock()
+    sumoLogger.enqueue(&sumoLog{
+      line: buffered.line,
+      source: source,
+      time: buffered.time,
+      isPartial: false,
+      spoolAck: buffered.ack,
+    })
+    return
+  }
+  sumoLogger.partialMu.Unlock()
+}
+
+/* flushStalePartialBuffers emits any partial buffer that has not seen a new fragment within
+  partialTimeout, for sources whose stream stalls mid-line (e.g. the container exits). It stops
+  as soon as sumoLogger.done is closed, the same signal consumeLogsFromFile and tailSpool use,
+  instead of a flush-specific stop channel that could fire a send after logQueue's only other
+  producer had already wound down. */
+func flushStalePartialBuffers(sumoLogger *sumoLogger) {
+  ticker := time.NewTicker(sumoLogger.partialTimeout)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-sumoLogger.done:
+      return
+    case <-ticker.C:
+      sumoLogger.partialMu.Lock()
+      now := time.Now()
+      for source, buffered := range sumoLogger.partialBuffers {
+        if now.Sub(buffered.lastUpdate) < sumoLogger.partialTimeout {
+          continue
+        }
+        delete(sumoLogger.partialBuffers, source)
+        sumoLogger.enqueue(&sumoLog{
+          line: buffered.line,
+          source: source,
+          time: buffered.time,
+          isPartial: false,
+          spoolAck: buffered.ack,
+        })
+      }
+      sumoLogger.partialMu.Unlock()
+    }
+  }
+}
+
 func queueLogsForSending(sumoLogger *sumoLogger) {
   timer := time.NewTicker(sumoLogger.sendingInterval)
+  defer timer.Stop()
   var logs []*sumoLog
   for {
     select {
     case <-timer.C:
       logs = sumoLogger.sendLogs(logs)
-    case log, open := <-sumoLogger.logQueue:
-      if !open {
-        sumoLogger.sendLogs(logs)
-        return
-      }
+    case log := <-sumoLogger.logQueue:
       logs = append(logs, log)
       if len(logs) % sumoLogger.batchSize == 0 {
         logs = sumoLogger.sendLogs(logs)
       }
+    case <-sumoLogger.done:
+      logs = append(logs, sumoLogger.drainLogQueue()...)
+      sumoLogger.sendLogs(logs)
+      return
+    }
+    if sumoLogger.metricsAddr != "" {
+      queueDepth.With(sumoLogger.metricsLabels).Set(float64(len(sumoLogger.logQueue)))
+      if sumoLogger.spool != nil {
+        spoolBytes.With(sumoLogger.metricsLabels).Set(float64(sumoLogger.spool.Bytes()))
+      }
+    }
+  }
+}
+
+/* drainLogQueue collects whatever is already buffered in logQueue without blocking, so
+  queueLogsForSending can flush it on shutdown. logQueue is never closed (it has multiple
+  producers), so this is the only safe way to know "nothing more is coming right now". */
+func (sumoLogger *sumoLogger) drainLogQueue() []*sumoLog {
+  var drained []*sumoLog
+  for {
+    select {
+    case log := <-sumoLogger.logQueue:
+      drained = append(drained, log)
+    default:
+      return drained
     }
   }
 }
@@ -273,43 +676,151 @@ func (sumoLogger *sumoLogger) sendLogs(logs []*sumoLog) []*sumoLog {
     if upperBound > logsCount {
       upperBound = logsCount
     }
-    if err := sumoLogger.makePostRequest(logs[i:upperBound]); err != nil {
+    batch := logs[i:upperBound]
+    if err := sumoLogger.sendLogsWithRetry(batch); err != nil {
       logrus.Error(err)
       failedLogs = logs[i:logsCount]
       return failedLogs
     }
+    ackSpooledLogs(batch)
   }
   failedLogs = logs[:0]
   return failedLogs
 }
 
+/* ackSpooledLogs advances the spool read cursor past every spool-backed log in a batch that
+  has just been sent (or permanently dropped, which sendLogsWithRetry also reports as a nil
+  error since the batch has finished its delivery attempts either way). Acking the latest
+  entry in the batch is sufficient, since spool entries are acked in increasing order. */
+func ackSpooledLogs(batch []*sumoLog) {
+  for i := len(batch) - 1; i >= 0; i-- {
+    if batch[i].spoolAck != nil {
+      batch[i].spoolAck()
+      return
+    }
+  }
+}
+
+/* sendLogsWithRetry posts a single batch, retrying transient failures (network errors, 5xx,
+  429) with exponential backoff and jitter until retryMaxAttempts or retryMaxElapsed is reached.
+  4xx responses other than 429 are treated as permanent and the batch is dropped immediately. */
+func (sumoLogger *sumoLogger) sendLogsWithRetry(logs []*sumoLog) error {
+  start := time.Now()
+  var lastErr error
+  for attempt := 0; attempt < sumoLogger.retryMaxAttempts; attempt++ {
+    sendStart := time.Now()
+    err := sumoLogger.makePostRequest(logs)
+    if err == nil {
+      if sumoLogger.metricsAddr != "" {
+        logsSentTotal.With(sumoLogger.metricsLabels).Add(float64(len(logs)))
+        batchesSentTotal.With(sumoLogger.metricsLabels).Inc()
+        sendDurationSeconds.With(sumoLogger.metricsLabels).Observe(time.Since(sendStart).Seconds())
+      }
+      return nil
+    }
+    lastErr = err
+
+    statusErr, ok := err.(*httpStatusError)
+    if ok && statusErr.isPermanent() {
+      sumoLogger.dropBatch(len(logs), "permanent_error", err)
+      return nil
+    }
+
+    if attempt+1 >= sumoLogger.retryMaxAttempts || time.Since(start) >= sumoLogger.retryMaxElapsed {
+      break
+    }
+
+    wait := sumoLogger.backoffInterval(attempt)
+    if ok && statusErr.retryAfter > 0 {
+      wait = statusErr.retryAfter
+    }
+    logrus.Warnf("%s: retrying batch of %d logs after %s (attempt %d/%d): %v",
+      pluginName, len(logs), wait, attempt+1, sumoLogger.retryMaxAttempts, err)
+    if sumoLogger.metricsAddr != "" {
+      retryAttemptsTotal.With(sumoLogger.metricsLabels).Inc()
+    }
+    time.Sleep(wait)
+  }
+
+  sumoLogger.dropBatch(len(logs), "retries_exhausted", lastErr)
+  return nil
+}
+
+/* backoffInterval computes min(cap, base * 2^attempt) plus up to 20% jitter. */
+func (sumoLogger *sumoLogger) backoffInterval(attempt int) time.Duration {
+  backoff := sumoLogger.retryBaseInterval * time.Duration(1 << uint(attempt))
+  if backoff > sumoLogger.retryMaxInterval || backoff <= 0 {
+    backoff = sumoLogger.retryMaxInterval
+  }
+  jitter := time.Duration(rand.Int63n(int64(backoff) / 5 + 1))
+  return backoff + jitter
+}
+
+func (sumoLogger *sumoLogger) dropBatch(batchSize int, reason string, err error) {
+  dropped := atomic.AddUint64(&sumoLogger.droppedBatches, 1)
+  logrus.WithField("dropped_batches_total", dropped).
+    Errorf("%s: giving up on batch of %d logs: %v", pluginName, batchSize, err)
+  if sumoLogger.metricsAddr != "" {
+    logsDroppedTotal.With(mergeLabels(sumoLogger.metricsLabels, "reason", reason)).Add(float64(batchSize))
+  }
+}
+
+/* mergeLabels copies base and adds a single extra key, for metric vectors (like
+  logsDroppedTotal) that add a label beyond the common container set. */
+func mergeLabels(base prometheus.Labels, key string, value string) prometheus.Labels {
+  merged := make(prometheus.Labels, len(base)+1)
+  for k, v := range base {
+    merged[k] = v
+  }
+  merged[key] = value
+  return merged
+}
+
+/* postBufferPool reuses the bytes.Buffer used to render each batch so high-throughput
+  containers don't allocate (and later GC) a fresh buffer per send. */
+var postBufferPool = sync.Pool{
+  New: func() interface{} { return new(bytes.Buffer) },
+}
+
 func (sumoLogger *sumoLogger) makePostRequest(logs []*sumoLog) error {
   logsCount := len(logs)
   if logsCount == 0 {
     return nil
   }
 
-  var logsBatch bytes.Buffer
+  logsBatch := postBufferPool.Get().(*bytes.Buffer)
+  logsBatch.Reset()
+  defer postBufferPool.Put(logsBatch)
+
   if sumoLogger.gzipCompression {
-    if err := sumoLogger.writeMessageGzipCompression(&logsBatch, logs); err != nil {
+    if err := sumoLogger.writeCompressed(logsBatch, logs); err != nil {
       return err
     }
   } else {
-    if err := sumoLogger.writeMessage(&logsBatch, logs); err != nil{
+    if err := sumoLogger.writePayload(logsBatch, logs); err != nil{
       return err
     }
   }
 
-  // TODO: error handling, retries and exponential backoff
-  request, err := http.NewRequest("POST", sumoLogger.httpSourceUrl, bytes.NewBuffer(logsBatch.Bytes()))
+  request, err := http.NewRequest("POST", sumoLogger.httpSourceUrl, bytes.NewReader(logsBatch.Bytes()))
   if err != nil {
     return err
   }
-  request.Header.Add("Content-Type", "text/plain")
+  request.Header.Add("Content-Type", sumoLogger.contentType())
   if sumoLogger.gzipCompression {
-    request.Header.Add("Content-Encoding", "gzip")
+    request.Header.Add("Content-Encoding", sumoLogger.compressAlgorithm)
+  }
+  if sumoLogger.sourceCategory != "" {
+    request.Header.Add("X-Sumo-Category", sumoLogger.sourceCategory)
+  }
+  if sumoLogger.sourceHost != "" {
+    request.Header.Add("X-Sumo-Host", sumoLogger.sourceHost)
+  }
+  if sumoLogger.sourceName != "" {
+    request.Header.Add("X-Sumo-Name", sumoLogger.sourceName)
   }
 
+  payloadSize := logsBatch.Len()
   response, err := sumoLogger.httpClient.Do(request)
   if err != nil {
     return err
@@ -321,12 +832,53 @@ func (sumoLogger *sumoLogger) makePostRequest(logs []*sumoLog) error {
     if err != nil {
       return err
     }
-    return fmt.Errorf("%s: Failed to send event: %s - %s", pluginName, response.Status, body)
+    return &httpStatusError{
+      statusCode: response.StatusCode,
+      retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+      body: string(body),
+    }
+  }
+  if sumoLogger.metricsAddr != "" {
+    bytesSentTotal.With(sumoLogger.metricsLabels).Add(float64(payloadSize))
   }
   return nil
 }
 
-func (sumoLogger *sumoLogger) writeMessage(writer io.Writer, logs []*sumoLog) error {
+/* parseRetryAfter understands the delay-seconds form of Retry-After; the HTTP-date form is
+  not emitted by Sumo and is treated as "no hint". */
+func parseRetryAfter(header string) time.Duration {
+  if header == "" {
+    return 0
+  }
+  seconds, err := strconv.Atoi(header)
+  if err != nil || seconds < 0 {
+    return 0
+  }
+  return time.Duration(seconds) * time.Second
+}
+
+func (sumoLogger *sumoLogger) contentType() string {
+  if sumoLogger.format == formatJson || sumoLogger.format == formatNdjson {
+    return "application/json"
+  }
+  return "text/plain"
+}
+
+/* writePayload renders a batch of logs according to sumoLogger.format: "text" writes the raw
+  newline-delimited log lines Sumo has always received, while "json" and "ndjson" emit
+  structured records carrying container metadata. */
+func (sumoLogger *sumoLogger) writePayload(writer io.Writer, logs []*sumoLog) error {
+  switch sumoLogger.format {
+  case formatJson:
+    return sumoLogger.writeMessageJson(writer, logs)
+  case formatNdjson:
+    return sumoLogger.writeMessageNdjson(writer, logs)
+  default:
+    return sumoLogger.writeMessageText(writer, logs)
+  }
+}
+
+func (sumoLogger *sumoLogger) writeMessageText(writer io.Writer, logs []*sumoLog) error {
   for _, log := range logs {
     if _, err := writer.Write(append(log.line, []byte("\n")...)); err != nil {
       return err
@@ -335,12 +887,69 @@ func (sumoLogger *sumoLogger) writeMessage(writer io.Writer, logs []*sumoLog) er
   return nil
 }
 
+/* sumoJsonLog is the structured record emitted when sumo-format is "json" or "ndjson". */
+type sumoJsonLog struct {
+  Timestamp string `json:"timestamp"`
+  Source string `json:"source"`
+  ContainerID string `json:"container_id"`
+  ContainerName string `json:"container_name"`
+  Image string `json:"image"`
+  Labels map[string]string `json:"labels"`
+  Message string `json:"message"`
+}
+
+func (sumoLogger *sumoLogger) toJsonLog(log *sumoLog) sumoJsonLog {
+  return sumoJsonLog{
+    Timestamp: log.time,
+    Source: log.source,
+    ContainerID: sumoLogger.containerID,
+    ContainerName: sumoLogger.containerName,
+    Image: sumoLogger.containerImage,
+    Labels: sumoLogger.containerLabels,
+    Message: string(log.line),
+  }
+}
+
+/* writeMessageJson renders the batch as a single JSON array. */
+func (sumoLogger *sumoLogger) writeMessageJson(writer io.Writer, logs []*sumoLog) error {
+  jsonLogs := make([]sumoJsonLog, len(logs))
+  for i, log := range logs {
+    jsonLogs[i] = sumoLogger.toJsonLog(log)
+  }
+  return json.NewEncoder(writer).Encode(jsonLogs)
+}
+
+/* writeMessageNdjson renders the batch as newline-delimited JSON objects, one per log. */
+func (sumoLogger *sumoLogger) writeMessageNdjson(writer io.Writer, logs []*sumoLog) error {
+  encoder := json.NewEncoder(writer)
+  for _, log := range logs {
+    if err := encoder.Encode(sumoLogger.toJsonLog(log)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/* writeCompressed renders the payload through sumoLogger.compressAlgorithm. Compression runs
+  inline on the send goroutine, so zstd's speed advantage over gzip at a comparable ratio keeps
+  it from becoming a batching bottleneck under high throughput. */
+func (sumoLogger *sumoLogger) writeCompressed(writer io.Writer, logs []*sumoLog) error {
+  switch sumoLogger.compressAlgorithm {
+  case compressAlgorithmDeflate:
+    return sumoLogger.writeMessageDeflateCompression(writer, logs)
+  case compressAlgorithmZstd:
+    return sumoLogger.writeMessageZstdCompression(writer, logs)
+  default:
+    return sumoLogger.writeMessageGzipCompression(writer, logs)
+  }
+}
+
 func (sumoLogger *sumoLogger) writeMessageGzipCompression(writer io.Writer, logs []*sumoLog) error {
   gzipWriter, err := gzip.NewWriterLevel(writer, sumoLogger.gzipCompressionLevel)
   if err != nil {
     return err
   }
-  if err := sumoLogger.writeMessage(gzipWriter, logs); err != nil {
+  if err := sumoLogger.writePayload(gzipWriter, logs); err != nil {
     return err
   }
   if err := gzipWriter.Close(); err != nil {
@@ -349,6 +958,52 @@ func (sumoLogger *sumoLogger) writeMessageGzipCompression(writer io.Writer, logs
   return nil
 }
 
+func (sumoLogger *sumoLogger) writeMessageDeflateCompression(writer io.Writer, logs []*sumoLog) error {
+  zlibWriter, err := zlib.NewWriterLevel(writer, sumoLogger.gzipCompressionLevel)
+  if err != nil {
+    return err
+  }
+  if err := sumoLogger.writePayload(zlibWriter, logs); err != nil {
+    return err
+  }
+  if err := zlibWriter.Close(); err != nil {
+    return err
+  }
+  return nil
+}
+
+func (sumoLogger *sumoLogger) writeMessageZstdCompression(writer io.Writer, logs []*sumoLog) error {
+  zstdWriter, err := zstd.NewWriter(writer, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdCompressionLevel)))
+  if err != nil {
+    return err
+  }
+  if err := sumoLogger.writePayload(zstdWriter, logs); err != nil {
+    zstdWriter.Close()
+    return err
+  }
+  return zstdWriter.Close()
+}
+
+/* resolveSourceTemplate evaluates value as a Go template against info, similar to jsonfilelog's
+  tag templating, so users can derive X-Sumo-* headers from fields like {{.ContainerName}}. A
+  plain string with no template directives is returned unchanged. */
+func resolveSourceTemplate(value string, info logger.Info) string {
+  if value == "" {
+    return ""
+  }
+  tmpl, err := template.New("sumo-source").Parse(value)
+  if err != nil {
+    logrus.Error(fmt.Errorf("error parsing source template %q: %v", value, err))
+    return value
+  }
+  var resolved bytes.Buffer
+  if err := tmpl.Execute(&resolved, info); err != nil {
+    logrus.Error(fmt.Errorf("error evaluating source template %q: %v", value, err))
+    return value
+  }
+  return resolved.String()
+}
+
 func parseLogOptInt(info logger.Info, logOptKey string, defaultValue int) int {
   if input, exists := info.Config[logOptKey]; exists {
     inputValue, err := strconv.ParseInt(input, stringToIntBase, stringToIntBitSize)
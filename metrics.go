@@ -0,0 +1,162 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "sync"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+  "github.com/sirupsen/logrus"
+)
+
+/* containerLabels is the common label set attached to every container-scoped series, so
+  operators can slice dashboards and alerts per container. */
+var containerLabels = []string{"container_id", "container_name", "image"}
+
+var (
+  logsReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "logs_received_total",
+    Help: "Total number of log entries received from the container.",
+  }, containerLabels)
+
+  logsSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "logs_sent_total",
+    Help: "Total number of log entries successfully delivered to Sumo Logic.",
+  }, containerLabels)
+
+  logsDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "logs_dropped_total",
+    Help: "Total number of log entries dropped without being delivered to Sumo Logic.",
+  }, append(append([]string{}, containerLabels...), "reason"))
+
+  batchesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "batches_sent_total",
+    Help: "Total number of log batches successfully posted to Sumo Logic.",
+  }, containerLabels)
+
+  bytesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "bytes_sent_total",
+    Help: "Total number of payload bytes successfully posted to Sumo Logic.",
+  }, containerLabels)
+
+  sendDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "send_duration_seconds",
+    Help: "Duration of successful batch POST requests to Sumo Logic.",
+    Buckets: prometheus.DefBuckets,
+  }, containerLabels)
+
+  retryAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "retry_attempts_total",
+    Help: "Total number of retry attempts made while delivering batches to Sumo Logic.",
+  }, containerLabels)
+
+  queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "queue_depth",
+    Help: "Current number of log entries buffered in the in-memory queue.",
+  }, containerLabels)
+
+  spoolBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "spool_bytes",
+    Help: "Current number of bytes held in the on-disk spool, if enabled.",
+  }, containerLabels)
+)
+
+func init() {
+  prometheus.MustRegister(
+    logsReceivedTotal,
+    logsSentTotal,
+    logsDroppedTotal,
+    batchesSentTotal,
+    bytesSentTotal,
+    sendDurationSeconds,
+    retryAttemptsTotal,
+    queueDepth,
+    spoolBytes,
+  )
+}
+
+/* dropReasons enumerates the values the "reason" label of logsDroppedTotal can take, so
+  unregisterContainerMetrics knows every series to remove for a stopped container:
+  "queue_full" (logQueue was at sumo-queue-size capacity when a log arrived), "retries_exhausted"
+  (a transient delivery error persisted past retryMaxAttempts/retryMaxElapsed) and
+  "permanent_error" (a non-429 4xx response from Sumo). */
+var dropReasons = []string{"queue_full", "retries_exhausted", "permanent_error"}
+
+/* unregisterContainerMetrics removes every series for a container from the process-wide
+  registry once its logger stops, so Prometheus doesn't keep serving stale series for
+  containers that no longer exist. */
+func unregisterContainerMetrics(labels prometheus.Labels) {
+  logsReceivedTotal.Delete(labels)
+  logsSentTotal.Delete(labels)
+  batchesSentTotal.Delete(labels)
+  bytesSentTotal.Delete(labels)
+  sendDurationSeconds.Delete(labels)
+  retryAttemptsTotal.Delete(labels)
+  queueDepth.Delete(labels)
+  spoolBytes.Delete(labels)
+
+  for _, reason := range dropReasons {
+    dropLabels := prometheus.Labels{}
+    for key, value := range labels {
+      dropLabels[key] = value
+    }
+    dropLabels["reason"] = reason
+    logsDroppedTotal.Delete(dropLabels)
+  }
+}
+
+/* metricsServer wraps the /metrics HTTP server for a single sumo-metrics-addr. Several
+  containers can share the same addr, so servers are refcounted and only torn down once the
+  last container using them stops logging. */
+type metricsServer struct {
+  server *http.Server
+  refCount int
+}
+
+var metricsServersMu sync.Mutex
+var metricsServers = make(map[string]*metricsServer)
+
+/* acquireMetricsServer starts (or joins) the /metrics server listening on addr. */
+func acquireMetricsServer(addr string) error {
+  metricsServersMu.Lock()
+  defer metricsServersMu.Unlock()
+
+  if existing, ok := metricsServers[addr]; ok {
+    existing.refCount++
+    return nil
+  }
+
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", promhttp.Handler())
+  server := &http.Server{Addr: addr, Handler: mux}
+  metricsServers[addr] = &metricsServer{server: server, refCount: 1}
+
+  go func() {
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+      logrus.Error(fmt.Errorf("metrics server on %q stopped: %v", addr, err))
+    }
+  }()
+  return nil
+}
+
+/* releaseMetricsServer decrements the refcount for addr, shutting the server down once the
+  last container using it has stopped. */
+func releaseMetricsServer(addr string) {
+  metricsServersMu.Lock()
+  defer metricsServersMu.Unlock()
+
+  existing, ok := metricsServers[addr]
+  if !ok {
+    return
+  }
+  existing.refCount--
+  if existing.refCount > 0 {
+    return
+  }
+  delete(metricsServers, addr)
+  if err := existing.server.Shutdown(context.Background()); err != nil {
+    logrus.Error(fmt.Errorf("error shutting down metrics server on %q: %v", addr, err))
+  }
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+  "compress/gzip"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/docker/docker/api/types/plugins/logdriver"
+  protoio "github.com/gogo/protobuf/io"
+  "github.com/sirupsen/logrus"
+)
+
+const (
+  spoolActiveSuffix = ".active.spool"
+  spoolSegmentSuffix = ".spool"
+  spoolGzipSuffix = ".gz"
+  spoolCursorName = "cursor"
+)
+
+/* diskSpool persists decoded LogEntry records to a rotating set of files so the driver can
+  survive restarts and Sumo outages longer than the in-memory logQueue can buffer. Records are
+  written uint32-length-prefixed, big-endian, matching protoio.NewUint32DelimitedReader so a
+  spoolReader can recover them the same way consumeLogsFromFile recovers records from the fifo.
+
+  Every segment, active or rotated, keeps a single immutable id assigned when it is created
+  (its creation-time UnixNano). Rotation only renames the file to drop the ".active" suffix and
+  mints a new, strictly greater id for the next active segment — it never reassigns the id of
+  data already on disk. This keeps segment ordering a simple numeric comparison regardless of
+  which segment happens to be "active" at any moment. */
+type diskSpool struct {
+  dir string
+  maxSegmentSize int64
+  maxFiles int
+  compress bool
+
+  mu sync.Mutex
+  activeID int64
+  activeName string
+  activeFile *os.File
+  activeWriter protoio.WriteCloser
+  activeSize int64
+}
+
+func newDiskSpool(dir string, maxSegmentSize int64, maxFiles int, compress bool) (*diskSpool, error) {
+  if err := os.MkdirAll(dir, fileMode); err != nil {
+    return nil, fmt.Errorf("error creating spool directory %q: %v", dir, err)
+  }
+  spool := &diskSpool{
+    dir: dir,
+    maxSegmentSize: maxSegmentSize,
+    maxFiles: maxFiles,
+    compress: compress,
+  }
+  if err := spool.openActiveSegment(); err != nil {
+    return nil, err
+  }
+  return spool, nil
+}
+
+/* openActiveSegment resumes the active segment left behind by a previous run, if any, so a
+  driver restart doesn't orphan an in-progress segment under a new id; otherwise it mints a
+  fresh one. */
+func (spool *diskSpool) openActiveSegment() error {
+  id, name, err := findActiveSegment(spool.dir)
+  if err != nil {
+    return err
+  }
+  if name == "" {
+    id = time.Now().UnixNano()
+    if id <= spool.activeID {
+      /* Guards against two rotations landing in the same nanosecond, which would otherwise
+        mint a new active segment with an id that collides with (or sorts behind) the one
+        just rotated out from under it. */
+      id = spool.activeID + 1
+    }
+    name = activeSegmentName(id)
+  }
+
+  path := filepath.Join(spool.dir, name)
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, fileMode)
+  if err != nil {
+    return fmt.Errorf("error opening spool segment %q: %v", path, err)
+  }
+  info, err := file.Stat()
+  if err != nil {
+    file.Close()
+    return err
+  }
+  spool.activeID = id
+  spool.activeName = name
+  spool.activeFile = file
+  spool.activeWriter = protoio.NewUint32DelimitedWriter(file, binary.BigEndian)
+  spool.activeSize = info.Size()
+  return nil
+}
+
+func activeSegmentName(id int64) string {
+  return fmt.Sprintf("%d%s", id, spoolActiveSuffix)
+}
+
+func rotatedSegmentName(id int64) string {
+  return fmt.Sprintf("%d%s", id, spoolSegmentSuffix)
+}
+
+func findActiveSegment(dir string) (int64, string, error) {
+  entries, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return 0, "", err
+  }
+  for _, entry := range entries {
+    if strings.HasSuffix(entry.Name(), spoolActiveSuffix) {
+      id, err := parseSegmentID(entry.Name(), spoolActiveSuffix)
+      if err != nil {
+        continue
+      }
+      return id, entry.Name(), nil
+    }
+  }
+  return 0, "", nil
+}
+
+func parseSegmentID(name string, suffix string) (int64, error) {
+  return strconv.ParseInt(strings.TrimSuffix(name, suffix), 10, 64)
+}
+
+/* Write appends a single decoded LogEntry to the active segment, rotating to a fresh segment
+  once maxSegmentSize is reached. */
+func (spool *diskSpool) Write(entry *logdriver.LogEntry) error {
+  spool.mu.Lock()
+  defer spool.mu.Unlock()
+
+  if err := spool.activeWriter.WriteMsg(entry); err != nil {
+    return err
+  }
+  spool.activeSize += int64(entry.Size()) + 4
+  if spool.activeSize >= spool.maxSegmentSize {
+    return spool.rotate()
+  }
+  return nil
+}
+
+func (spool *diskSpool) rotate() error {
+  if err := spool.activeWriter.Close(); err != nil {
+    logrus.Error(fmt.Errorf("error closing spool segment: %v", err))
+  }
+  rotatedName := rotatedSegmentName(spool.activeID)
+  rotatedPath := filepath.Join(spool.dir, rotatedName)
+  if err := os.Rename(filepath.Join(spool.dir, spool.activeName), rotatedPath); err != nil {
+    return fmt.Errorf("error rotating spool segment: %v", err)
+  }
+
+  if spool.compress {
+    go spool.compressSegment(rotatedPath)
+  }
+
+  if err := spool.openActiveSegment(); err != nil {
+    return err
+  }
+  go spool.enforceRetention()
+  return nil
+}
+
+func (spool *diskSpool) compressSegment(path string) {
+  if err := compressFile(path, path+spoolGzipSuffix); err != nil {
+    logrus.Error(fmt.Errorf("error compressing spool segment %q: %v", path, err))
+    return
+  }
+  if err := os.Remove(path); err != nil {
+    logrus.Error(fmt.Errorf("error removing uncompressed spool segment %q: %v", path, err))
+  }
+}
+
+func compressFile(srcPath string, dstPath string) error {
+  src, err := os.Open(srcPath)
+  if err != nil {
+    return err
+  }
+  defer src.Close()
+
+  dst, err := os.Create(dstPath)
+  if err != nil {
+    return err
+  }
+  defer dst.Close()
+
+  gzipWriter := gzip.NewWriter(dst)
+  if _, err := io.Copy(gzipWriter, src); err != nil {
+    return err
+  }
+  return gzipWriter.Close()
+}
+
+/* enforceRetention removes the oldest rotated segments once there are more than maxFiles on
+  disk. The active segment is never counted or removed. */
+func (spool *diskSpool) enforceRetention() {
+  segments, err := spool.listSegments()
+  if err != nil {
+    logrus.Error(fmt.Errorf("error listing spool segments: %v", err))
+    return
+  }
+  var rotated []segmentInfo
+  for _, segment := range segments {
+    if !segment.active {
+      rotated = append(rotated, segment)
+    }
+  }
+  if len(rotated) <= spool.maxFiles {
+    return
+  }
+  for _, segment := range rotated[:len(rotated)-spool.maxFiles] {
+    if err := os.Remove(filepath.Join(spool.dir, segment.name)); err != nil {
+      logrus.Error(fmt.Errorf("error removing spool segment %q: %v", segment.name, err))
+    }
+  }
+}
+
+/* segmentInfo describes one segment file on disk: its immutable creation id, its current file
+  name (which changes as it moves from active to rotated to compressed) and whether it is the
+  one still being appended to. */
+type segmentInfo struct {
+  id int64
+  name string
+  active bool
+  compressed bool
+}
+
+/* listSegments returns every segment on disk, oldest (lowest id) first. */
+func (spool *diskSpool) listSegments() ([]segmentInfo, error) {
+  entries, err := ioutil.ReadDir(spool.dir)
+  if err != nil {
+    return nil, err
+  }
+  var segments []segmentInfo
+  for _, entry := range entries {
+    name := entry.Name()
+    switch {
+    case name == spoolCursorName || strings.HasSuffix(name, ".tmp"):
+      continue
+    case strings.HasSuffix(name, spoolActiveSuffix):
+      id, err := parseSegmentID(name, spoolActiveSuffix)
+      if err != nil {
+        continue
+      }
+      segments = append(segments, segmentInfo{id: id, name: name, active: true})
+    case strings.HasSuffix(name, spoolSegmentSuffix+spoolGzipSuffix):
+      id, err := parseSegmentID(name, spoolSegmentSuffix+spoolGzipSuffix)
+      if err != nil {
+        continue
+      }
+      segments = append(segments, segmentInfo{id: id, name: name, compressed: true})
+    case strings.HasSuffix(name, spoolSegmentSuffix):
+      id, err := parseSegmentID(name, spoolSegmentSuffix)
+      if err != nil {
+        continue
+      }
+      segments = append(segments, segmentInfo{id: id, name: name})
+    }
+  }
+  sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+  return segments, nil
+}
+
+func (spool *diskSpool) Close() error {
+  spool.mu.Lock()
+  defer spool.mu.Unlock()
+  return spool.activeWriter.Close()
+}
+
+/* Bytes returns the total size in bytes currently held on disk across all segments, for
+  reporting via the spool_bytes metric. */
+func (spool *diskSpool) Bytes() int64 {
+  var total int64
+  entries, err := ioutil.ReadDir(spool.dir)
+  if err != nil {
+    return 0
+  }
+  for _, entry := range entries {
+    if entry.Name() == spoolCursorName {
+      continue
+    }
+    total += entry.Size()
+  }
+  return total
+}
+
+/* spoolReader tails the spool directory, starting from the cursor persisted on the previous
+  run (if any), and only advances that cursor once the entries it handed out have been
+  acknowledged as successfully sent. The cursor tracks a segment id plus a count of entries
+  already consumed from that segment, rather than a byte offset, so resuming works the same way
+  whether or not the segment has since been gzip-compressed. */
+type spoolReader struct {
+  spool *diskSpool
+  cursorPath string
+}
+
+func newSpoolReader(spool *diskSpool) *spoolReader {
+  return &spoolReader{
+    spool: spool,
+    cursorPath: filepath.Join(spool.dir, spoolCursorName),
+  }
+}
+
+type spoolCursor struct {
+  segmentID int64
+  entryCount int64
+}
+
+func (reader *spoolReader) loadCursor() spoolCursor {
+  data, err := ioutil.ReadFile(reader.cursorPath)
+  if err != nil {
+    return spoolCursor{}
+  }
+  var segmentID, entryCount int64
+  if _, err := fmt.Sscanf(string(data), "%d %d", &segmentID, &entryCount); err != nil {
+    return spoolCursor{}
+  }
+  return spoolCursor{segmentID: segmentID, entryCount: entryCount}
+}
+
+/* saveCursor persists the cursor atomically via write-then-rename so a crash mid-write never
+  leaves a corrupt cursor file behind. */
+func (reader *spoolReader) saveCursor(cursor spoolCursor) {
+  tmpPath := reader.cursorPath + ".tmp"
+  contents := fmt.Sprintf("%d %d", cursor.segmentID, cursor.entryCount)
+  if err := ioutil.WriteFile(tmpPath, []byte(contents), fileMode); err != nil {
+    logrus.Error(fmt.Errorf("error writing spool cursor: %v", err))
+    return
+  }
+  if err := os.Rename(tmpPath, reader.cursorPath); err != nil {
+    logrus.Error(fmt.Errorf("error persisting spool cursor: %v", err))
+  }
+}
+
+/* tailSpool feeds reassembled logs from the on-disk spool instead of directly from the fifo,
+  running every raw entry back through handlePartialEntry so multi-fragment partial lines are
+  reassembled the same way whether or not the spool is enabled (the spool itself holds raw,
+  unreassembled records, since consumeLogsFromFile writes them before any merging happens).
+
+  Two positions are tracked: readPos is how far this process has read in-memory, and advances
+  immediately after each readSegment call so a single run never re-reads the same record twice;
+  the on-disk cursor only advances when a read entry's merged log is actually acked as sent, via
+  the ack closures readSegment attaches to each entry. readPos therefore always leads the
+  persisted cursor by however many entries are in flight, and a restart resumes from the
+  persisted cursor, re-reading (and re-emitting) whatever was in flight but unacked when it
+  stopped — an accepted at-least-once duplicate, never a loss.
+
+  It stops as soon as sumoLogger.done is closed, rather than relying on logQueue being closed,
+  since logQueue has other producers that must not see it closed out from under them. */
+func tailSpool(sumoLogger *sumoLogger) {
+  reader := newSpoolReader(sumoLogger.spool)
+  readPos := reader.loadCursor()
+
+  for {
+    select {
+    case <-sumoLogger.done:
+      return
+    default:
+    }
+
+    segments, err := reader.spool.listSegments()
+    if err != nil {
+      logrus.Error(fmt.Errorf("error listing spool segments: %v", err))
+      if !sumoLogger.sleepOrStop(sumoLogger.sendingInterval) {
+        return
+      }
+      continue
+    }
+
+    advanced := false
+    for _, segment := range segments {
+      if segment.id < readPos.segmentID {
+        continue
+      }
+      skip := int64(0)
+      if segment.id == readPos.segmentID {
+        skip = readPos.entryCount
+      }
+      consumed, err := reader.readSegment(sumoLogger, segment, skip)
+      if err != nil {
+        logrus.Error(fmt.Errorf("error reading spool segment %q: %v", segment.name, err))
+        break
+      }
+      if consumed > skip || segment.id != readPos.segmentID {
+        advanced = true
+      }
+      readPos = spoolCursor{segmentID: segment.id, entryCount: consumed}
+    }
+
+    if !advanced {
+      if !sumoLogger.sleepOrStop(sumoLogger.sendingInterval) {
+        return
+      }
+    }
+  }
+}
+
+/* sleepOrStop waits for d, returning false early (without having waited) if the logger stops
+  in the meantime. */
+func (sumoLogger *sumoLogger) sleepOrStop(d time.Duration) bool {
+  select {
+  case <-time.After(d):
+    return true
+  case <-sumoLogger.done:
+    return false
+  }
+}
+
+/* readSegment decodes entries from segment starting after the first skip entries, handing each
+  new one to sumoLogger.handlePartialEntry with an ack closure that persists the cursor past it
+  once it has actually been sent. It returns the total number of entries read from the segment
+  so far (skip plus whatever was read this pass), for the caller's in-memory readPos. */
+func (reader *spoolReader) readSegment(sumoLogger *sumoLogger, segment segmentInfo, skip int64) (int64, error) {
+  path := filepath.Join(reader.spool.dir, segment.name)
+  raw, err := os.Open(path)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return skip, nil
+    }
+    return skip, err
+  }
+  defer raw.Close()
+
+  var source io.Reader = raw
+  if segment.compressed {
+    gzipReader, err := gzip.NewReader(raw)
+    if err != nil {
+      return skip, err
+    }
+    defer gzipReader.Close()
+    source = gzipReader
+  }
+
+  dec := protoio.NewUint32DelimitedReader(source, binary.BigEndian, fileReaderMaxSize)
+  defer dec.Close()
+
+  var entry logdriver.LogEntry
+  var consumed int64
+  for ; consumed < skip; consumed++ {
+    if err := dec.ReadMsg(&entry); err != nil {
+      if err == io.EOF {
+        return consumed, nil
+      }
+      return consumed, err
+    }
+    entry.Reset()
+  }
+
+  for {
+    select {
+    case <-sumoLogger.done:
+      return consumed, nil
+    default:
+    }
+
+    if err := dec.ReadMsg(&entry); err != nil {
+      if err == io.EOF {
+        return consumed, nil
+      }
+      return consumed, err
+    }
+    consumed++
+
+    segmentID := segment.id
+    ackEntryCount := consumed
+    sumoLogger.handlePartialEntry(
+      entry.Source,
+      append([]byte(nil), entry.Line...),
+      time.Unix(0, entry.TimeNano).String(),
+      entry.Partial,
+      func() { reader.saveCursor(spoolCursor{segmentID: segmentID, entryCount: ackEntryCount}) },
+    )
+    entry.Reset()
+  }
+}